@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// cleanupExpiredTokens purges expired tokens every cleanup interval until
+// stop is closed. Each run deletes in batches, so no single statement holds
+// locks on a large part of the tokens table.
+func (app *application) cleanupExpiredTokens(stop <-chan struct{}) {
+	deleted := expvar.NewInt("expired_tokens_deleted")
+	runs := expvar.NewInt("expired_tokens_cleanup_runs")
+
+	ticker := time.NewTicker(app.config.cleanup.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var total int64
+
+		for {
+			n, err := app.models.Tokens.DeleteExpired(app.config.cleanup.batchSize)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				break
+			}
+
+			total += n
+			deleted.Add(n)
+
+			//a short batch means nothing is left, also stop early on shutdown
+			if n < int64(app.config.cleanup.batchSize) {
+				break
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		runs.Add(1)
+
+		if total > 0 {
+			app.logger.PrintInfo("deleted expired tokens", map[string]string{
+				"count": strconv.FormatInt(total, 10),
+			})
+		}
+	}
+}
@@ -5,11 +5,18 @@ import (
 	"net/http"
 
 	"github.com/leebrouse/greenLight/internal/data"
+	"github.com/leebrouse/greenLight/internal/jwt"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey            = contextKey("user")
+	permissionScopeContextKey = contextKey("permissionScope")
+	signedClaimsContextKey    = contextKey("signedClaims")
+	sessionContextKey         = contextKey("session")
+	apiKeyContextKey          = contextKey("apiKey")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +30,63 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// contextSetPermissionScope restricts the request to the given permission codes,
+// on top of the permissions of the user.
+func (app *application) contextSetPermissionScope(r *http.Request, scope data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionScopeContextKey, scope)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissionScope returns nil when the request is not restricted.
+func (app *application) contextGetPermissionScope(r *http.Request) data.Permissions {
+	scope, ok := r.Context().Value(permissionScopeContextKey).(data.Permissions)
+	if !ok {
+		return nil
+	}
+	return scope
+}
+
+func (app *application) contextSetSignedClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), signedClaimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetSignedClaims returns nil unless the request used a signed access token.
+func (app *application) contextGetSignedClaims(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(signedClaimsContextKey).(*jwt.Claims)
+	if !ok {
+		return nil
+	}
+	return claims
+}
+
+// contextSetSession records the session the request was authenticated with.
+// For signed access tokens only the family is known.
+func (app *application) contextSetSession(r *http.Request, session *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns nil unless the request used an access token.
+func (app *application) contextGetSession(r *http.Request) *data.Token {
+	session, ok := r.Context().Value(sessionContextKey).(*data.Token)
+	if !ok {
+		return nil
+	}
+	return session
+}
+
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns nil unless the request used an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 //terminal,web interface,response header
@@ -87,3 +90,26 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) restrictedCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key or a scoped token, please log in with your password"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// user have sent the right password, but the account requires a second factor
+func (app *application) otpRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a one-time password is required for this account"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidOTPResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired one-time password"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// too many failed logins for the email address or the client IP
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
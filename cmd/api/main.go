@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
 	"strings"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/leebrouse/greenLight/internal/data"
 	"github.com/leebrouse/greenLight/internal/jsonlog"
+	"github.com/leebrouse/greenLight/internal/jwt"
 	"github.com/leebrouse/greenLight/internal/mailer"
 	_ "github.com/lib/pq"
 )
@@ -46,14 +49,58 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+
+	permissions struct {
+		cacheTTL time.Duration
+	}
+
+	auth struct {
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		tokenMode       string
+		signingKeys     []string
+		signingKeyID    string
+		//signed tokens are valid until they expire, even once revoked
+		signedTokenMaxTTL time.Duration
+	}
+
+	login struct {
+		maxFailures   int
+		maxFailuresIP int
+		lockout       time.Duration
+	}
+
+	password struct {
+		breachedList       string
+		rejectPersonalInfo bool
+		argon2Memory       uint
+		argon2Iterations   uint
+		argon2Parallelism  uint
+	}
+
+	cleanup struct {
+		interval  time.Duration
+		batchSize int
+	}
+
+	registration struct {
+		inviteOnly         bool
+		defaultPermissions []string
+		defaultRoles       []string
+		domainPermissions  map[string][]string
+		domainRoles        map[string][]string
+	}
 }
 
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config    config
+	logger    *jsonlog.Logger
+	models    data.Models
+	mailer    mailer.Mailer
+	signer    *jwt.KeySet
+	logins    *loginThrottle
+	passwords *data.PasswordPolicy
+	wg        sync.WaitGroup
 }
 
 func main() {
@@ -81,6 +128,63 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "a5dfc034127342", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.leebrouse.net>", "SMTP sender")
 
+	//config permission cache (0 disables it)
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", time.Minute, "Permission cache TTL (0 to disable)")
+
+	//config authentication token lifetimes
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Default authentication (access) token TTL")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Refresh token TTL")
+
+	//config signed access tokens
+	//eg --auth-signing-keys="2026-10=HS256:/etc/greenlight/hmac.key 2026-04=EdDSA:/etc/greenlight/ed25519.pem"
+	flag.StringVar(&cfg.auth.tokenMode, "auth-token-mode", "opaque", "Authentication token mode (opaque|signed)")
+	flag.Func("auth-signing-keys", "Signing keys as kid=alg:path (space separated, alg is HS256 or EdDSA)", func(val string) error {
+		cfg.auth.signingKeys = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.auth.signingKeyID, "auth-signing-key-id", "", "Key ID used to sign new access tokens")
+	flag.DurationVar(&cfg.auth.signedTokenMaxTTL, "auth-signed-token-max-ttl", 15*time.Minute, "Maximum TTL of signed access tokens, which stay valid until they expire even if revoked")
+
+	//config login brute-force protection
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins per email before it is locked out")
+	flag.IntVar(&cfg.login.maxFailuresIP, "login-max-failures-ip", 50, "Failed logins per client IP before it is locked out")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "Login lockout duration")
+
+	//config password policy
+	flag.StringVar(&cfg.password.breachedList, "password-breached-list", "", "Sorted file of hex SHA-1 hashes of breached passwords to reject, one per line")
+	flag.BoolVar(&cfg.password.rejectPersonalInfo, "password-reject-personal-info", false, "Reject passwords containing the user's name or email")
+	flag.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", 64*1024, "Argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2Iterations, "password-argon2-iterations", 3, "Argon2id iterations")
+	flag.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", 2, "Argon2id parallelism")
+
+	//config expired token cleanup
+	flag.DurationVar(&cfg.cleanup.interval, "cleanup-interval", time.Hour, "Interval between expired token cleanups (0 disables them)")
+	flag.IntVar(&cfg.cleanup.batchSize, "cleanup-batch-size", 1000, "Expired tokens deleted per statement")
+
+	//config registration
+	flag.BoolVar(&cfg.registration.inviteOnly, "registration-invite-only", false, "Require an invitation code to register")
+
+	//eg --registration-default-permissions="movies:read" --registration-domain-permissions="example.com=movies:write"
+	cfg.registration.defaultPermissions = []string{"movies:read", "reviews:write"}
+	flag.Func("registration-default-permissions", "Permission codes granted to new users (space separated, default \"movies:read reviews:write\")", func(val string) error {
+		cfg.registration.defaultPermissions = strings.Fields(val)
+		return nil
+	})
+	flag.Func("registration-default-roles", "Roles granted to new users (space separated)", func(val string) error {
+		cfg.registration.defaultRoles = strings.Fields(val)
+		return nil
+	})
+	flag.Func("registration-domain-permissions", "Extra permission codes per email domain (eg \"example.com=movies:write\")", func(val string) error {
+		rules, err := parseDomainRules(val)
+		cfg.registration.domainPermissions = rules
+		return err
+	})
+	flag.Func("registration-domain-roles", "Extra roles per email domain (eg \"example.com=editor\")", func(val string) error {
+		rules, err := parseDomainRules(val)
+		cfg.registration.domainRoles = rules
+		return err
+	})
+
 	//eg --cors-trusted-origins="example.com api.example.com"---------> ["example.com", "api.example.com"]
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
@@ -91,6 +195,24 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	signer, err := loadSigningKeys(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	err = setArgon2Params(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	passwords := data.NewPasswordPolicy(cfg.password.rejectPersonalInfo)
+	if cfg.password.breachedList != "" {
+		err = passwords.LoadBreachedList(cfg.password.breachedList)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -113,16 +235,31 @@ func main() {
 		return db.Stats()
 	}))
 
+	models := data.NewModels(db, cfg.permissions.cacheTTL)
+
+	err = checkRegistrationAccess(cfg, models)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Publish the permission cache hit and miss counters.
+	expvar.Publish("permissions_cache", expvar.Func(func() any {
+		return models.Permissions.Cache.Stats()
+	}))
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:    cfg,
+		logger:    logger,
+		models:    models,
+		mailer:    mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		signer:    signer,
+		logins:    newLoginThrottle(cfg.login.maxFailures, cfg.login.maxFailuresIP, cfg.login.lockout),
+		passwords: passwords,
 	}
 
 	if err = app.serve(); err != nil {
@@ -131,6 +268,70 @@ func main() {
 
 }
 
+// setArgon2Params checks the argon2id flags before they are narrowed to the
+// types argon2 takes, so an out of range value can't wrap around.
+func setArgon2Params(cfg config) error {
+	switch {
+	case cfg.password.argon2Iterations < 1 || cfg.password.argon2Iterations > 100:
+		return fmt.Errorf("password-argon2-iterations must be between 1 and 100, got %d", cfg.password.argon2Iterations)
+	case cfg.password.argon2Parallelism < 1 || cfg.password.argon2Parallelism > 255:
+		return fmt.Errorf("password-argon2-parallelism must be between 1 and 255, got %d", cfg.password.argon2Parallelism)
+	case cfg.password.argon2Memory < 8*1024 || cfg.password.argon2Memory > 4*1024*1024:
+		return fmt.Errorf("password-argon2-memory must be between 8192 KiB (8 MiB) and 4194304 KiB (4 GiB), got %d", cfg.password.argon2Memory)
+	}
+
+	data.PasswordHashParams.Memory = uint32(cfg.password.argon2Memory)
+	data.PasswordHashParams.Iterations = uint32(cfg.password.argon2Iterations)
+	data.PasswordHashParams.Parallelism = uint8(cfg.password.argon2Parallelism)
+
+	return nil
+}
+
+// loadSigningKeys reads the keys given by --auth-signing-keys. It returns a nil
+// KeySet when no keys are configured, which is only allowed in opaque mode.
+func loadSigningKeys(cfg config) (*jwt.KeySet, error) {
+	switch cfg.auth.tokenMode {
+	case "opaque", "signed":
+	default:
+		return nil, fmt.Errorf("invalid auth-token-mode %q", cfg.auth.tokenMode)
+	}
+
+	//logout, password changes and revoked sessions only stop signed tokens
+	//from being refreshed, so they must be short-lived
+	if cfg.auth.tokenMode == "signed" && cfg.auth.accessTokenTTL > cfg.auth.signedTokenMaxTTL {
+		return nil, fmt.Errorf("auth-access-token-ttl %s is more than auth-signed-token-max-ttl %s", cfg.auth.accessTokenTTL, cfg.auth.signedTokenMaxTTL)
+	}
+
+	if len(cfg.auth.signingKeys) == 0 {
+		if cfg.auth.tokenMode == "signed" {
+			return nil, errors.New("auth-token-mode signed requires auth-signing-keys")
+		}
+		return nil, nil
+	}
+
+	var keys []*jwt.Key
+
+	for _, spec := range cfg.auth.signingKeys {
+		//kid=alg:path
+		id, rest, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid signing key %q", spec)
+		}
+		alg, path, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid signing key %q", spec)
+		}
+
+		key, err := jwt.LoadKey(id, alg, path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewKeySet(cfg.auth.signingKeyID, keys...)
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	//sql open
 	db, err := sql.Open("postgres", cfg.db.dsn)
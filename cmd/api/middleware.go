@@ -14,6 +14,7 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/leebrouse/greenLight/internal/data"
+	"github.com/leebrouse/greenLight/internal/jwt"
 	"github.com/leebrouse/greenLight/internal/validator"
 	"golang.org/x/time/rate"
 )
@@ -120,6 +121,18 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		//get token
 		token := headerParts[1]
 
+		//API keys have their own prefix and table
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		//signed access tokens are verified without the database
+		if app.signer != nil && jwt.IsSigned(token) {
+			app.authenticateSignedToken(w, r, next, token)
+			return
+		}
+
 		//new Validatir
 		v := validator.New()
 
@@ -142,14 +155,129 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		//record the session activity
+		session, err := app.models.Tokens.UpdateLastUsed(data.ScopeAuthentication, token, r.UserAgent(), app.clientIP(r))
+		if err != nil {
+			switch {
+			//the token was revoked in the meantime
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
 		//call contextSetUser
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSession(r, session)
+
+		//a scoped token only carries some of the permissions of the user
+		if session.Permissions != nil {
+			r = app.contextSetPermissionScope(r, session.Permissions)
+		}
 		//next
 		next.ServeHTTP(w, r)
 
 	})
 }
 
+// authenticateAPIKey sets the owner of the key as the request user and
+// restricts the request to the permission codes stored with the key.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	//check key format
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	//get the key by the given plaintext
+	key, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//the last use is only recorded once a minute
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		err = app.models.APIKeys.UpdateLastUsed(key.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	r = app.contextSetPermissionScope(r, key.Permissions)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateSignedToken builds the request user from the claims of a signed
+// access token. Only the ID and activation status are known, handlers which
+// need the full record must be wrapped with loadCurrentUser.
+func (app *application) authenticateSignedToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := app.signer.Verify(token, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user := &data.User{ID: id, Activated: claims.Activated}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetSignedClaims(r, claims)
+	r = app.contextSetSession(r, &data.Token{UserID: id, Family: claims.SessionID})
+	if claims.Scope != nil {
+		r = app.contextSetPermissionScope(r, *claims.Scope)
+	}
+	next.ServeHTTP(w, r)
+}
+
+// loadCurrentUser replaces the user built from a signed access token with the
+// full record from the database.
+func (app *application) loadCurrentUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetSignedClaims(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			//the user was deleted after the token was issued
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
 /* Moive part middle */
 // Create a new requireAuthenticatedUser() middleware to check that a user is not anonymous.
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
@@ -189,12 +317,26 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireUnscopedCredentials refuses requests made with restricted credentials,
+// that is API keys, scoped tokens and tokens with a custom ttl. It protects the
+// routes which manage the account and its credentials, a restricted credential
+// must not be able to widen or outlive itself through them.
+func (app *application) requireUnscopedCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil || app.contextGetPermissionScope(r) != nil {
+			app.restrictedCredentialsResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permissions for the request, that is the permissions
+		// of the user restricted to the scope of the credentials used.
+		permissions, err := app.requestPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -213,6 +355,31 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// requestPermissions returns the permissions of the current user, intersected
+// with the permission scope of the request when there is one.
+func (app *application) requestPermissions(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := app.contextGetPermissionScope(r)
+	if scope == nil {
+		return permissions, nil
+	}
+
+	var scoped data.Permissions
+	for _, code := range permissions {
+		if scope.Include(code) {
+			scoped = append(scoped, code)
+		}
+	}
+
+	return scoped, nil
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Origin" header.
@@ -23,10 +23,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Note that the movie variable contains a *pointer* to a Movie struct.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: app.contextGetUser(r).ID,
 	}
 	v := validator.New()
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -100,6 +101,11 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	//only the owner or a movies:admin may edit the movie
+	if !app.canModifyMovie(w, r, movie) {
+		return
+	}
+
 	var input struct {
 		Title   *string       `json:"title"`
 		Year    *int32        `json:"year"`
@@ -162,8 +168,25 @@ func (app *application) deletMovieHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	//check the movie
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//only the owner or a movies:admin may delete the movie
+	if !app.canModifyMovie(w, r, movie) {
+		return
+	}
+
 	//delete
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(movie.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -202,7 +225,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Filters.PageSize = app.readint(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "average_rating", "review_count", "-id", "-title", "-year", "-runtime", "-average_rating", "-review_count"}
 
 	//validator check
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -221,3 +244,26 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// canModifyMovie reports whether the current user owns the movie or holds the
+// movies:admin permission. If not, an error response has already been sent.
+func (app *application) canModifyMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	user := app.contextGetUser(r)
+
+	if movie.CreatedBy == user.ID {
+		return true
+	}
+
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !permissions.Include("movies:admin") {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
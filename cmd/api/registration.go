@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/leebrouse/greenLight/internal/data"
+)
+
+// parseDomainRules parses "example.com=movies:read,movies:write other.org=..."
+// into the values granted per email domain.
+func parseDomainRules(val string) (map[string][]string, error) {
+	rules := make(map[string][]string)
+
+	for _, field := range strings.Fields(val) {
+		domain, values, ok := strings.Cut(field, "=")
+		if !ok || domain == "" || values == "" {
+			return nil, fmt.Errorf("invalid domain rule %q, expected domain=value,value", field)
+		}
+
+		domain = strings.ToLower(domain)
+		rules[domain] = append(rules[domain], strings.Split(values, ",")...)
+	}
+
+	return rules, nil
+}
+
+// registrationAccess returns the permission codes and role names a new user
+// with the given email starts with: the defaults plus the rules for its domain.
+func (app *application) registrationAccess(email string) (permissions, roles []string) {
+	permissions = slices.Clone(app.config.registration.defaultPermissions)
+	roles = slices.Clone(app.config.registration.defaultRoles)
+
+	_, domain, _ := strings.Cut(email, "@")
+	domain = strings.ToLower(domain)
+
+	for _, code := range app.config.registration.domainPermissions[domain] {
+		if !slices.Contains(permissions, code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	for _, name := range app.config.registration.domainRoles[domain] {
+		if !slices.Contains(roles, name) {
+			roles = append(roles, name)
+		}
+	}
+
+	return permissions, roles
+}
+
+// checkRegistrationAccess makes sure every configured permission code and role
+// exists, a typo would otherwise silently grant nothing.
+func checkRegistrationAccess(cfg config, models data.Models) error {
+	known, err := models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+
+	codes := slices.Clone(cfg.registration.defaultPermissions)
+	for _, domainCodes := range cfg.registration.domainPermissions {
+		codes = append(codes, domainCodes...)
+	}
+
+	for _, code := range codes {
+		if !known.Include(code) {
+			return fmt.Errorf("unknown permission code %q in the registration config", code)
+		}
+	}
+
+	roles, err := models.Roles.GetAll()
+	if err != nil {
+		return err
+	}
+
+	names := slices.Clone(cfg.registration.defaultRoles)
+	for _, domainRoles := range cfg.registration.domainRoles {
+		names = append(names, domainRoles...)
+	}
+
+	for _, name := range names {
+		if !slices.ContainsFunc(roles, func(role *data.Role) bool { return role.Name == name }) {
+			return fmt.Errorf("unknown role %q in the registration config", name)
+		}
+	}
+
+	return nil
+}
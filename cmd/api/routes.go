@@ -27,15 +27,84 @@ func (app *application) router() http.Handler {
 	//movies:write
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deletMovieHandler))
 
+	//reviews:write, reading them only needs movies:read
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.createReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.deleteReviewHandler))
+
 	//add user register handler (method:POST)
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 
 	//add activate user handler (method:PUT)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	//read and change the account of the current user
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.loadCurrentUser(app.showCurrentUserHandler))))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.updateCurrentUserHandler))))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.updateCurrentUserPasswordHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.loadCurrentUser(app.deleteCurrentUserHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.loadCurrentUser(app.exportCurrentUserHandler))))
+
+	//API keys for service-to-service clients
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireUnscopedCredentials(app.requireActivatedUser(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireUnscopedCredentials(app.requireActivatedUser(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys/:id", app.requireUnscopedCredentials(app.requireActivatedUser(app.showAPIKeyHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/api-keys/:id", app.requireUnscopedCredentials(app.requireActivatedUser(app.updateAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireUnscopedCredentials(app.requireActivatedUser(app.deleteAPIKeyHandler)))
+
+	//change the email address of the current user, confirmed with a token sent to the new address
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.createEmailChangeHandler))))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+
+	//TOTP two-factor authentication of the current user
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/totp", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.createTOTPHandler))))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/2fa/totp", app.requireUnscopedCredentials(app.requireActivatedUser(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa/totp", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.deleteTOTPHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/recovery-codes", app.requireUnscopedCredentials(app.requireActivatedUser(app.loadCurrentUser(app.createRecoveryCodesHandler))))
+
+	//list and revoke the sessions of the current user
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.listSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.deleteSessionHandler)))
+
+	//reset user password with a password-reset token (method:PUT)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	//users:admin
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.grantUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.revokeUserRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invitations", app.requirePermission("users:admin", app.createInvitationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invitations", app.requirePermission("users:admin", app.listInvitationsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/invitations/:id", app.requirePermission("users:admin", app.deleteInvitationHandler))
+
 	//POST http://localhost:4000/v1/tokens/authentication
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
+	//POST http://localhost:4000/v1/tokens/refresh
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+
+	//DELETE http://localhost:4000/v1/tokens/authentication (logout)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	//DELETE http://localhost:4000/v1/tokens/authentication/all (logout everywhere)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireUnscopedCredentials(app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler)))
+
+	//POST http://localhost:4000/v1/tokens/password-reset
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	//POST http://localhost:4000/v1/tokens/activation
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+
+	//POST http://localhost:4000/v1/tokens/magic-link
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	//POST http://localhost:4000/v1/tokens/magic-link/redeem
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/redeem", app.redeemMagicLinkTokenHandler)
+
 	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
@@ -24,6 +24,16 @@ func (app *application) serve() error {
 	// 创建一个 shutdownError 通道，用于接收 Shutdown() 返回的错误
 	shutdownError := make(chan error)
 
+	// stop 通道在关闭时通知后台的维护任务退出
+	stop := make(chan struct{})
+
+	// 定期清理过期的 token
+	if app.config.cleanup.interval > 0 && app.config.cleanup.batchSize > 0 {
+		app.background(func() {
+			app.cleanupExpiredTokens(stop)
+		})
+	}
+
 	// 启动一个 goroutine 来等待停止信号并to implement graceful shutdown
 	go func() {
 		// 监听中断信号（SIGINT 或 SIGTERM）
@@ -48,6 +58,7 @@ func (app *application) serve() error {
 			"addr": srv.Addr,
 		})
 
+		close(stop)
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
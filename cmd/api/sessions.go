@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/leebrouse/greenLight/internal/data"
+)
+
+// sessionScope returns the scope of the tokens that stand for the sessions of
+// a user. Signed access tokens aren't stored, so in signed mode a session is
+// the unused refresh token of its family. Logins without a refresh token
+// (scoped or custom ttl) aren't listed there, they can't be revoked anyway.
+func (app *application) sessionScope() string {
+	if app.config.auth.tokenMode == "signed" {
+		return data.ScopeRefresh
+	}
+
+	return data.ScopeAuthentication
+}
+
+// List the active sessions (authentication tokens) of the current user
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	//get the unexpired authentication tokens
+	sessions, err := app.models.Tokens.GetAllForUser(app.sessionScope(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//write json, the token hashes are never sent to the client
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Kill a single session of the current user
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	//param request
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	//delete, together with the rest of its family
+	err = app.models.Tokens.DeleteByID(app.sessionScope(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//write json
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
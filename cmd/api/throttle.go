@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginThrottle counts failed logins per email address and per client IP.
+// After a few free attempts every failure doubles the wait before the next
+// attempt, and after maxFailures the key is locked for the lockout duration.
+type loginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+
+	freeFailures  int
+	maxFailures   int
+	maxFailuresIP int
+	baseDelay     time.Duration
+	lockout       time.Duration
+}
+
+type loginAttempts struct {
+	failures     int
+	blockedUntil time.Time
+	lastSeen     time.Time
+}
+
+func newLoginThrottle(maxFailures, maxFailuresIP int, lockout time.Duration) *loginThrottle {
+	t := &loginThrottle{
+		attempts:      make(map[string]*loginAttempts),
+		freeFailures:  3,
+		maxFailures:   maxFailures,
+		maxFailuresIP: maxFailuresIP,
+		baseDelay:     time.Second,
+		lockout:       lockout,
+	}
+
+	// forget the keys nobody has tried for a while
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			t.mu.Lock()
+			for key, attempts := range t.attempts {
+				if time.Since(attempts.lastSeen) > t.lockout && time.Now().After(attempts.blockedUntil) {
+					delete(t.attempts, key)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}()
+
+	return t
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// retryAfter returns how long the client has to wait before trying to log
+// in with this email from this IP, zero when it may try now.
+func (t *loginThrottle) retryAfter(email, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range []string{emailKey(email), ipKey(ip)} {
+		if attempts, found := t.attempts[key]; found {
+			if d := time.Until(attempts.blockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// fail records a failed login and reports whether the email address has just
+// been locked out, so the owner can be told about it exactly once.
+func (t *loginThrottle) fail(email, ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.record(ipKey(ip), t.maxFailuresIP)
+	return t.record(emailKey(email), t.maxFailures)
+}
+
+func (t *loginThrottle) record(key string, maxFailures int) bool {
+	attempts, found := t.attempts[key]
+	if !found {
+		attempts = &loginAttempts{}
+		t.attempts[key] = attempts
+	}
+
+	now := time.Now()
+	attempts.failures++
+	attempts.lastSeen = now
+
+	switch {
+	case attempts.failures == maxFailures:
+		attempts.blockedUntil = now.Add(t.lockout)
+		return true
+	case attempts.failures > maxFailures:
+		attempts.blockedUntil = now.Add(t.lockout)
+	case attempts.failures > t.freeFailures:
+		delay := t.lockout
+		// cap the shift so the delay can't overflow
+		if shift := attempts.failures - t.freeFailures - 1; shift < 20 {
+			delay = min(t.baseDelay<<shift, t.lockout)
+		}
+		attempts.blockedUntil = now.Add(delay)
+	}
+
+	return false
+}
+
+// succeed forgets the failures of the email address after a successful login.
+func (t *loginThrottle) succeed(email string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, emailKey(email))
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/leebrouse/greenLight/internal/data"
+	"github.com/leebrouse/greenLight/internal/jwt"
 	"github.com/leebrouse/greenLight/internal/validator"
 )
 
@@ -13,8 +16,11 @@ import (
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	//input struct
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string   `json:"email"`
+		Password    string   `json:"password"`
+		Permissions []string `json:"permissions"`
+		TTL         *string  `json:"ttl"`
+		OTP         string   `json:"otp"`
 	}
 	//read json data from the input
 	err := app.readJSON(w, r, &input)
@@ -30,17 +36,44 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePassword(v, input.Password)
 
+	//the token lives as long as configured unless another ttl (eg "30m") is requested
+	ttl := app.config.auth.accessTokenTTL
+	if input.TTL != nil {
+		ttl, err = time.ParseDuration(*input.TTL)
+		if err != nil {
+			v.AddError("ttl", "must be a valid duration")
+		} else {
+			data.ValidateTokenTTL(v, ttl)
+			//signed tokens can't be revoked, so they can't outlive the cap
+			if app.config.auth.tokenMode == "signed" {
+				v.Check(ttl <= app.config.auth.signedTokenMaxTTL, "ttl", "must not be more than "+app.config.auth.signedTokenMaxTTL.String())
+			}
+		}
+	}
+
+	//an empty list is a valid scope, the token then carries no permissions at all
+	if input.Permissions != nil {
+		v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	}
+
 	//throw the err if validator have
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	//don't even check the password while the email or the IP is blocked
+	if wait := app.logins.retryAfter(input.Email, app.clientIP(r)); wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return
+	}
+
 	//from the email get the user
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.loginFailed(r, input.Email, nil)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -56,22 +89,613 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		app.loginFailed(r, input.Email, user)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	//new token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	//users with 2FA enabled must also send a code or a recovery code
+	if !app.checkLoginSecondFactor(w, r, user, input.OTP) {
+		return
+	}
+
+	app.logins.succeed(input.Email)
+
+	//upgrade bcrypt or outdated argon2id hashes now that we know the plaintext
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			//someone else updated the user, the next login will try again
+			case errors.Is(err, data.ErrEditConflict):
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	//the token can't carry permissions the user doesn't hold. A token with a
+	//custom ttl is restricted too: it carries the current permissions of the
+	//user as its scope, so it can't manage the account or mint other credentials
+	var scope data.Permissions
+	if input.Permissions != nil || input.TTL != nil {
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		scope = data.Permissions{}
+		if input.Permissions == nil {
+			scope = append(scope, permissions...)
+		}
+
+		for _, code := range input.Permissions {
+			v.Check(permissions.Include(code), "permissions", "must only contain permission codes you hold")
+			scope = append(scope, code)
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	//new family
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//new access and refresh tokens
+	session := data.Token{Permissions: scope, Family: family}
+	env, err := app.newSession(app.models, r, user, session, ttl)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//write json message
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+}
+
+// loginFailed records a failed login and emails the owner of the account
+// when it has just been locked out.
+func (app *application) loginFailed(r *http.Request, email string, user *data.User) {
+	locked := app.logins.fail(email, app.clientIP(r))
+	if !locked || user == nil {
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"name":    user.Name,
+			"lockout": app.config.login.lockout.String(),
+		}
+
+		err := app.mailer.Send(user.Email, "user_locked.tmpl.html", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// Rotate a refresh token: the used one is spent and a new pair is issued
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//input struct
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	//read json data from the input
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//check the token format
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//spend the refresh token and issue the new pair, the refresh token stays
+	//unused if the new one can't be stored
+	var env envelope
+	err = app.models.WithTx(func(tx data.Models) error {
+		used, err := tx.Tokens.UseRefreshToken(input.RefreshToken)
+		if err != nil {
+			return err
+		}
+
+		//restricted sessions don't get refresh tokens, don't extend those issued before
+		if used.Permissions != nil {
+			return data.ErrRecordNotFound
+		}
+
+		user, err := tx.Users.Get(used.UserID)
+		if err != nil {
+			return err
+		}
+
+		//the new pair stays in the family
+		session := data.Token{Family: used.Family}
+		env, err = app.newSession(tx, r, user, session, app.config.auth.accessTokenTTL)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			//revoke the family after the rollback, so it isn't rolled back too
+			err = app.models.Tokens.RevokeReusedFamily(input.RefreshToken)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.logger.PrintInfo("refresh token reused, token family revoked", map[string]string{
+				"client_ip": app.clientIP(r),
+			})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//write json message
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newSession issues an access token with the given ttl and a refresh token
+// for the user, permission scope and family of the session. The access token
+// is signed instead of stored when the signed token mode is configured. Both
+// are stored with the given models, in one transaction.
+//
+// Sessions with a permission scope (scoped or custom ttl logins) only get the
+// access token: a refresh would issue a token with the default ttl and lifetime.
+func (app *application) newSession(models data.Models, r *http.Request, user *data.User, session data.Token, ttl time.Duration) (envelope, error) {
+	session.UserID = user.ID
+	session.UserAgent = r.UserAgent()
+	session.ClientIP = app.clientIP(r)
+
+	var token interface{}
+
+	if app.config.auth.tokenMode == "signed" {
+		now := time.Now()
+		claims := jwt.Claims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+			SessionID: session.Family,
+			Activated: user.Activated,
+		}
+		if session.Permissions != nil {
+			scope := []string(session.Permissions)
+			claims.Scope = &scope
+		}
+
+		signed, err := app.signer.Sign(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		token = envelope{"token": signed, "expiry": time.Unix(claims.ExpiresAt, 0)}
+	}
+
+	var refreshToken *data.Token
+	err := models.WithTx(func(tx data.Models) error {
+		if token == nil {
+			opaque, err := tx.Tokens.NewSession(data.ScopeAuthentication, ttl, session)
+			if err != nil {
+				return err
+			}
+
+			token = opaque
+		}
+
+		if session.Permissions != nil {
+			return nil
+		}
+
+		var err error
+		refreshToken, err = tx.Tokens.NewSession(data.ScopeRefresh, app.config.auth.refreshTokenTTL, session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{"authentication_token": token}
+	if refreshToken != nil {
+		env["refresh_token"] = refreshToken
+	}
+
+	return env, nil
+}
+
+// Generate a password reset token and send it to the user's email address
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//input struct
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	//read json data from the input
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//check the format of the email
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//from the email get the user
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//only activated users can reset their password
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//new token with a short expiry
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//send the password reset email in the background
+	app.background(func() {
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_password_reset.tmpl.html", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	//write json message
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generate a fresh activation token for a user whose welcome email was lost
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//input struct
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	//read json data from the input
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//check the format of the email
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//from the email get the user
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//nothing to do if the user has been activated already
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//delete the old activation tokens so only the newest one is valid
+	var token *data.Token
+	err = app.models.WithTx(func(tx data.Models) error {
+		err := tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//send the activation email in the background
+	app.background(func() {
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_activation.tmpl.html", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	//write json message
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the authentication token used for the current request
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	//a signed token can't be deleted, but its session can't be refreshed anymore
+	if claims := app.contextGetSignedClaims(r); claims != nil {
+		err := app.models.Tokens.DeleteFamily(claims.SessionID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//the header format has already been checked by the authenticate middleware
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	//delete the token
+	err := app.models.Tokens.DeleteForToken(data.ScopeAuthentication, token, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//write json message
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke every authentication token of the current user
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	//delete the tokens
+	err := app.models.WithTx(func(tx data.Models) error {
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+			err := tx.Tokens.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//write json message
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Email a single-use login link to the user
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//input struct
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	//read json data from the input
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//check the format of the email
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//a locked account can't get around the lockout this way
+	if wait := app.logins.retryAfter(input.Email, app.clientIP(r)); wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return
+	}
+
+	//from the email get the user
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//new token with a short expiry
+	token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeMagicLink)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	//send the magic link email in the background
+	app.background(func() {
+		data := map[string]interface{}{
+			"magicLinkToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_magic_link.tmpl.html", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
 	//write json message
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	env := envelope{"message": "an email will be sent to you containing a login link"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a magic link token for a normal authentication token
+func (app *application) redeemMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//input struct
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		OTP            string `json:"otp"`
+	}
+
+	//read json data from the input
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	//check the token format
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//get user data by the given token
+	user, err := app.models.Users.GetForToken(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic link token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if wait := app.logins.retryAfter(user.Email, app.clientIP(r)); wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return
+	}
+
+	//the link replaces the password, not the second factor.
+	//the token is kept until the code is right so the user can retry
+	if !app.checkLoginSecondFactor(w, r, user, input.OTP) {
+		return
+	}
+
+	//new family
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//spend the token and issue new access and refresh tokens, if the token is
+	//already gone another request redeemed it first
+	var env envelope
+	err = app.models.WithTx(func(tx data.Models) error {
+		err := tx.Tokens.DeleteForToken(data.ScopeMagicLink, input.TokenPlaintext, user.ID)
+		if err != nil {
+			return err
+		}
+
+		env, err = app.newSession(tx, r, user, data.Token{Family: family}, app.config.auth.accessTokenTTL)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic link token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logins.succeed(user.Email)
+
+	//write json message
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/leebrouse/greenLight/internal/data"
+	"github.com/leebrouse/greenLight/internal/totp"
+	"github.com/leebrouse/greenLight/internal/validator"
+)
+
+const (
+	//accept the codes of the previous and the next time step too
+	totpSkew = 1
+	//the number of recovery codes handed out at once
+	totpRecoveryCodes = 10
+)
+
+// Start the TOTP enrolment of the current user
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	//read json
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//match the password
+	v := validator.New()
+	if !app.checkPassword(w, r, v, user, "password", input.Password) {
+		return
+	}
+
+	//an enabled second factor has to be removed before enrolling again
+	current, err := app.models.TOTP.Get(user.ID)
+	switch {
+	case err == nil && current.Enabled:
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//new secret
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Upsert(user.ID, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI("Greenlight", user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm the enrolment with a code from the authenticator app
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		OTP string `json:"otp"`
+	}
+
+	//read json
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.OTP != "", "otp", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secondFactor, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor enrolment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if secondFactor.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//only a code is accepted here, there are no recovery codes yet
+	ok, err := app.checkTOTPCode(secondFactor, input.OTP)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("otp", "invalid or expired one-time password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//enable 2FA together with its first recovery codes
+	var codes []string
+	err = app.models.WithTx(func(tx data.Models) error {
+		err := tx.TOTP.Enable(user.ID)
+		if err != nil {
+			return err
+		}
+
+		codes, err = tx.TOTP.NewRecoveryCodes(user.ID, totpRecoveryCodes)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Replace the recovery codes, the old ones stop working. Both the password and
+// a code are required
+func (app *application) createRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+		OTP      string `json:"otp"`
+	}
+
+	//read json
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//the code first, a correct password resets the failed attempts
+	v := validator.New()
+	if !app.checkSecondFactor(w, r, v, user, input.OTP) {
+		return
+	}
+	if !app.checkPassword(w, r, v, user, "password", input.Password) {
+		return
+	}
+
+	//the old codes are only deleted if the new ones are stored
+	var codes []string
+	err = app.models.WithTx(func(tx data.Models) error {
+		var err error
+		codes, err = tx.TOTP.NewRecoveryCodes(user.ID, totpRecoveryCodes)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Disable two-factor authentication, both the password and a code are required
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+		OTP      string `json:"otp"`
+	}
+
+	//read json
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//the code first, a correct password resets the failed attempts
+	v := validator.New()
+	if !app.checkSecondFactor(w, r, v, user, input.OTP) {
+		return
+	}
+	if !app.checkPassword(w, r, v, user, "password", input.Password) {
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkPassword matches the password of the user, key is the name of the
+// input field. Wrong passwords count against the login throttle, so a stolen
+// session can't be used to guess the password. If it doesn't match, an error
+// response has already been sent.
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User, key, password string) bool {
+	if v.Check(password != "", key, "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	if wait := app.logins.retryAfter(user.Email, app.clientIP(r)); wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		app.loginFailed(r, user.Email, user)
+		v.AddError(key, "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	app.logins.succeed(user.Email)
+
+	return true
+}
+
+// checkSecondFactor verifies a code or recovery code of a user with 2FA
+// enabled. Wrong codes count against the login throttle like wrong passwords,
+// but a correct one doesn't reset it. If it fails, an error response has
+// already been sent.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User, otp string) bool {
+	if v.Check(otp != "", "otp", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	if wait := app.logins.retryAfter(user.Email, app.clientIP(r)); wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return false
+	}
+
+	secondFactor, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication is not enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if !secondFactor.Enabled {
+		v.AddError("totp", "two-factor authentication is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	ok, err := app.verifyOTP(secondFactor, otp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.loginFailed(r, user.Email, user)
+		v.AddError("otp", "invalid or expired one-time password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// checkLoginSecondFactor asks users with 2FA enabled for a code or a recovery
+// code when they log in. A wrong code counts as a failed login. If it fails,
+// an error response has already been sent.
+func (app *application) checkLoginSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User, otp string) bool {
+	secondFactor, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if secondFactor == nil || !secondFactor.Enabled {
+		return true
+	}
+
+	if otp == "" {
+		app.otpRequiredResponse(w, r)
+		return false
+	}
+
+	ok, err := app.verifyOTP(secondFactor, otp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.loginFailed(r, user.Email, user)
+		app.invalidOTPResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// verifyOTP accepts either a code from the authenticator app or a recovery code.
+func (app *application) verifyOTP(secondFactor *data.TOTP, otp string) (bool, error) {
+	if len(otp) == totp.Digits {
+		return app.checkTOTPCode(secondFactor, otp)
+	}
+
+	return app.models.TOTP.UseRecoveryCode(secondFactor.UserID, otp)
+}
+
+// checkTOTPCode validates the code and spends its time step, so a code
+// intercepted by somebody else can't be used a second time.
+func (app *application) checkTOTPCode(secondFactor *data.TOTP, code string) (bool, error) {
+	step, ok := secondFactor.Validate(code, time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+
+	err := app.models.TOTP.UseStep(secondFactor.UserID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrOTPReplayed):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
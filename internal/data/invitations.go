@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/leebrouse/greenLight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// {
+// 	"id": 4,
+// 	"code": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+// 	"email": "alice@example.com",
+// 	"permissions": ["movies:read", "movies:write"],
+// 	"expiry": "2026-11-01T00:00:00Z"
+// }
+
+type Invitation struct {
+	ID          int64       `json:"id"`
+	Code        string      `json:"code,omitempty"`
+	Hash        []byte      `json:"-"`
+	Email       *string     `json:"email,omitempty"`
+	Permissions Permissions `json:"permissions"`
+	CreatedBy   int64       `json:"created_by,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      time.Time   `json:"expiry"`
+	UsedBy      *int64      `json:"used_by,omitempty"`
+	UsedAt      *time.Time  `json:"used_at,omitempty"`
+}
+
+func generateInvitationCode(invitation *Invitation) error {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	invitation.Code = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(invitation.Code))
+	invitation.Hash = hash[:]
+
+	return nil
+}
+
+func ValidateInvitationCode(v *validator.Validator, code string) {
+	v.Check(code != "", "invitation", "must be provided")
+	v.Check(len(code) == 26, "invitation", "must be 26 bytes long")
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	if invitation.Email != nil {
+		ValidateEmail(v, *invitation.Email)
+	}
+
+	v.Check(len(invitation.Permissions) >= 1, "permissions", "must contain at least 1 permission code")
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+
+	v.Check(invitation.Expiry.After(time.Now()), "expiry", "must be in the future")
+}
+
+type InvitationModel struct {
+	DB DBTX
+}
+
+// Generate a new code for the given invitation and store its hash
+func (m InvitationModel) Insert(invitation *Invitation) error {
+	err := generateInvitationCode(invitation)
+	if err != nil {
+		return err
+	}
+
+	query := `
+				INSERT INTO invitations (hash, email, permissions, created_by, expiry)
+				VALUES ($1, $2, $3, NULLIF($4, 0), $5)
+				RETURNING id, created_at
+			`
+	args := []interface{}{
+		invitation.Hash,
+		invitation.Email,
+		pq.Array([]string(invitation.Permissions)),
+		invitation.CreatedBy,
+		invitation.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// Retrieve an unused and unexpired invitation by its code
+func (m InvitationModel) GetForCode(code string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(code))
+
+	query := `
+				SELECT id, hash, email, permissions, COALESCE(created_by, 0), created_at, expiry, used_by, used_at
+				FROM invitations
+				WHERE hash = $1
+				AND used_at IS NULL
+				AND expiry > $2
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invitation Invitation
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&invitation.ID,
+		&invitation.Hash,
+		&invitation.Email,
+		pq.Array((*[]string)(&invitation.Permissions)),
+		&invitation.CreatedBy,
+		&invitation.CreatedAt,
+		&invitation.Expiry,
+		&invitation.UsedBy,
+		&invitation.UsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+func (m InvitationModel) GetAll() ([]*Invitation, error) {
+	query := `
+				SELECT id, hash, email, permissions, COALESCE(created_by, 0), created_at, expiry, used_by, used_at
+				FROM invitations
+				ORDER BY id
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.Hash,
+			&invitation.Email,
+			pq.Array((*[]string)(&invitation.Permissions)),
+			&invitation.CreatedBy,
+			&invitation.CreatedAt,
+			&invitation.Expiry,
+			&invitation.UsedBy,
+			&invitation.UsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// Mark the invitation as used by the given user. ErrRecordNotFound means it
+// was used by someone else in the meantime.
+func (m InvitationModel) Use(id, userID int64) error {
+	query := `
+				UPDATE invitations
+				SET used_by = $2, used_at = NOW()
+				WHERE id = $1 AND used_at IS NULL
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m InvitationModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+				DELETE FROM invitations
+				WHERE id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
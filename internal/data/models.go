@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,18 +12,80 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so every model can run its
+// queries inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type Models struct {
+	APIKeys     APIKeyModel
+	Invitations InvitationModel
 	Movies      MovieModel
 	Permissions PermissionModel
+	Reviews     ReviewModel
+	Roles       RoleModel
 	Users       UserModel
 	Tokens      TokenModel
+	TOTP        TOTPModel
+
+	//nil for the models handed out by WithTx
+	db *sql.DB
+}
+
+func NewModels(db *sql.DB, permissionCacheTTL time.Duration) Models {
+	models := newModels(db, NewPermissionCache(permissionCacheTTL))
+	models.db = db
+	return models
 }
 
-func NewModels(db *sql.DB) Models {
+func newModels(db DBTX, permissionCache *PermissionCache) Models {
 	return Models{
+		APIKeys:     APIKeyModel{DB: db},
+		Invitations: InvitationModel{DB: db},
 		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Permissions: PermissionModel{DB: db, Cache: permissionCache},
+		Reviews:     ReviewModel{DB: db},
+		Roles:       RoleModel{DB: db, Cache: permissionCache},
 		Users:       UserModel{DB: db},
 		Tokens:      TokenModel{DB: db},
+		TOTP:        TOTPModel{DB: db},
 	}
 }
+
+// WithTx runs fn with models bound to a single transaction. The transaction
+// is committed when fn returns nil and rolled back otherwise. Calling WithTx
+// on the models of a running transaction just joins it. Cached permissions
+// changed by fn are dropped once the transaction has committed.
+func (m Models) WithTx(fn func(tx Models) error) error {
+	if m.db == nil {
+		return fn(m)
+	}
+
+	tx, err := m.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pending := &pendingInvalidations{}
+
+	txModels := newModels(tx, m.Permissions.Cache)
+	txModels.Permissions.pending = pending
+	txModels.Roles.pending = pending
+
+	err = fn(txModels)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	pending.flush(m.Permissions.Cache)
+	return nil
+}
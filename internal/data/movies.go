@@ -30,9 +30,21 @@ type Movie struct {
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	CreatedBy int64     `json:"created_by,omitempty"`
+	//aggregated from the reviews of the movie
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int64   `json:"review_count"`
+	Version       int32   `json:"version"`
 }
 
+// movieRatings is joined to the movies table to get the review aggregates
+const movieRatings = `
+				LEFT JOIN (
+					SELECT movie_id, ROUND(AVG(rating), 2)::float8 AS rating_avg, count(*) AS rating_count
+					FROM reviews
+					GROUP BY movie_id
+				) ratings ON ratings.movie_id = movies.id`
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
@@ -53,17 +65,17 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // creat
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-				INSERT INTO movies (title, year, runtime, genres)
-				VALUES ($1, $2, $3, $4)
+				INSERT INTO movies (title, year, runtime, genres, created_by)
+				VALUES ($1, $2, $3, $4, NULLIF($5, 0))
 				RETURNING id, created_at, version
 			`
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -79,8 +91,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	query := `
-				SELECT id, created_at, title, year, runtime, genres, version
-				FROM movies
+				SELECT id, created_at, title, year, runtime, genres, COALESCE(created_by, 0),
+				COALESCE(rating_avg, 0), COALESCE(rating_count, 0), version
+				FROM movies` + movieRatings + `
 				WHERE id = $1
 			`
 
@@ -97,6 +110,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
+		&movie.AverageRating,
+		&movie.ReviewCount,
 		&movie.Version,
 	)
 
@@ -186,8 +202,9 @@ func (m MovieModel) Delete(id int64) error {
 }
 
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`SELECT count(*) OVER(),id, created_at, title, year, runtime, genres, version
-							FROM movies
+	query := fmt.Sprintf(`SELECT count(*) OVER(),id, created_at, title, year, runtime, genres, COALESCE(created_by, 0),
+							COALESCE(rating_avg, 0) AS average_rating, COALESCE(rating_count, 0) AS review_count, version
+							FROM movies`+movieRatings+`
 							WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
 							AND (genres @> $2 OR $2 = '{}')
 							ORDER BY %s %s,id ASC
@@ -219,6 +236,9 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.AverageRating,
+			&movie.ReviewCount,
 			&movie.Version,
 		)
 
@@ -237,3 +257,55 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	return movies, metadata, nil
 }
+
+// Retrieve every movie created by the given user
+func (m MovieModel) GetAllForUser(userID int64) ([]*Movie, error) {
+	query := `
+				SELECT id, created_at, title, year, runtime, genres, COALESCE(created_by, 0),
+				COALESCE(rating_avg, 0), COALESCE(rating_count, 0), version
+				FROM movies` + movieRatings + `
+				WHERE created_by = $1
+				ORDER BY id
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.AverageRating,
+			&movie.ReviewCount,
+			&movie.Version,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
@@ -0,0 +1,200 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, the tests only check the encoding
+var testHashParams = Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func withHashParams(t *testing.T, params Argon2Params) {
+	t.Helper()
+
+	saved := PasswordHashParams
+	PasswordHashParams = params
+	t.Cleanup(func() { PasswordHashParams = saved })
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hash, err := hashArgon2id("pa55word1234", testHashParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("unexpected encoding %q", hash)
+	}
+	if !isArgon2id(hash) {
+		t.Errorf("isArgon2id(%q) = false", hash)
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		t.Fatalf("decodeArgon2id: %v", err)
+	}
+	if params != testHashParams {
+		t.Errorf("got params %+v, want %+v", params, testHashParams)
+	}
+	if len(salt) != 16 || len(key) != 32 {
+		t.Errorf("got %d byte salt and %d byte key", len(salt), len(key))
+	}
+
+	for _, tt := range []struct {
+		plaintext string
+		want      bool
+	}{
+		{"pa55word1234", true},
+		{"pa55word1235", false},
+		{"", false},
+	} {
+		match, err := compareArgon2id(hash, tt.plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != tt.want {
+			t.Errorf("compareArgon2id(%q) = %v, want %v", tt.plaintext, match, tt.want)
+		}
+	}
+
+	//every hash gets its own salt
+	other, err := hashArgon2id("pa55word1234", testHashParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other) == string(hash) {
+		t.Error("two hashes of the same password are equal")
+	}
+}
+
+func TestDecodeArgon2idKeepsOtherParams(t *testing.T) {
+	//a hash made with other parameters still matches after they changed
+	stored := "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHRzb21lc2FsdA$" +
+		"xGaXr5G8kR7EBYMZv9Y6vM3ap7Ljk7fyaH5m8VQ/dIw"
+
+	params, salt, key, err := decodeArgon2id([]byte(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Argon2Params{Memory: 65536, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+	if params != want {
+		t.Errorf("got params %+v, want %+v", params, want)
+	}
+	if string(salt) != "somesaltsomesalt" || len(key) != 32 {
+		t.Errorf("got salt %q and %d byte key", salt, len(key))
+	}
+}
+
+func TestDecodeArgon2idRejectsMalformed(t *testing.T) {
+	const salt = "c29tZXNhbHRzb21lc2FsdA"
+	const key = "xGaXr5G8kR7EBYMZv9Y6vM3ap7Ljk7fyaH5m8VQ/dIw"
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"missing key", "$argon2id$v=19$m=65536,t=3,p=2$" + salt},
+		{"extra segment", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key + "$x"},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key},
+		{"bad version", "$argon2id$version$m=65536,t=3,p=2$" + salt + "$" + key},
+		{"bad params", "$argon2id$v=19$m=65536;t=3;p=2$" + salt + "$" + key},
+		{"zero iterations", "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key},
+		{"padded salt", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "==$" + key},
+		{"bad key", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$!!!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := decodeArgon2id([]byte(tt.hash))
+			if !errors.Is(err, ErrInvalidPasswordHash) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidPasswordHash)
+			}
+
+			//a broken hash is an error, not a mismatch
+			p := password{hash: []byte(tt.hash)}
+			if strings.HasPrefix(tt.hash, argon2idPrefix) {
+				if _, err := p.Matches("pa55word1234"); err == nil {
+					t.Error("Matches returned no error")
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordSetAndMatches(t *testing.T) {
+	withHashParams(t, testHashParams)
+
+	var p password
+	if err := p.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isArgon2id(p.hash) {
+		t.Errorf("Set stored %q, want an argon2id hash", p.hash)
+	}
+	if match, err := p.Matches("pa55word1234"); err != nil || !match {
+		t.Errorf("Matches(correct) = %v, %v", match, err)
+	}
+	if match, err := p.Matches("wrong password"); err != nil || match {
+		t.Errorf("Matches(wrong) = %v, %v", match, err)
+	}
+	if p.NeedsRehash() {
+		t.Error("NeedsRehash() = true for a hash with the current params")
+	}
+
+	//stronger params upgrade the hash at the next login
+	stronger := testHashParams
+	stronger.Iterations = 2
+	withHashParams(t, stronger)
+
+	if !p.NeedsRehash() {
+		t.Error("NeedsRehash() = false after the params changed")
+	}
+	if match, err := p.Matches("pa55word1234"); err != nil || !match {
+		t.Errorf("Matches(correct) after the params changed = %v, %v", match, err)
+	}
+}
+
+func TestPasswordLegacyBcrypt(t *testing.T) {
+	withHashParams(t, testHashParams)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pa55word1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := password{hash: hash}
+
+	if isArgon2id(p.hash) {
+		t.Errorf("isArgon2id(%q) = true", hash)
+	}
+	if match, err := p.Matches("pa55word1234"); err != nil || !match {
+		t.Errorf("Matches(correct) = %v, %v", match, err)
+	}
+	if match, err := p.Matches("wrong password"); err != nil || match {
+		t.Errorf("Matches(wrong) = %v, %v", match, err)
+	}
+	if !p.NeedsRehash() {
+		t.Error("NeedsRehash() = false for a bcrypt hash")
+	}
+
+	//the rehash replaces bcrypt with argon2id
+	if err := p.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if !isArgon2id(p.hash) || p.NeedsRehash() {
+		t.Errorf("hash %q was not upgraded", p.hash)
+	}
+}
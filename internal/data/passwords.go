@@ -0,0 +1,151 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/leebrouse/greenLight/internal/validator"
+)
+
+// PasswordPolicy holds the optional checks applied to new passwords on top
+// of ValidatePassword. A nil *PasswordPolicy accepts every password.
+type PasswordPolicy struct {
+	//sorted SHA-1 hashes of breached passwords, searched on disk
+	breached      *os.File
+	breachedCount int64
+	//reject passwords containing the name or email of the user
+	rejectPersonalInfo bool
+}
+
+// every record of the breached list is a hex encoded SHA-1 hash and a newline
+const breachedRecordSize = 2*sha1.Size + 1
+
+func NewPasswordPolicy(rejectPersonalInfo bool) *PasswordPolicy {
+	return &PasswordPolicy{rejectPersonalInfo: rejectPersonalInfo}
+}
+
+// LoadBreachedList opens a file of hex encoded SHA-1 hashes, one per line,
+// sorted and with Unix line endings. The file is searched on disk and stays
+// open. The Have I Been Pwned downloads carry a ":count" suffix and CRLF line
+// endings, they have to be converted first, eg
+//
+//	cut -d: -f1 pwned-passwords-sha1-ordered-by-hash.txt | tr -d '\r' > breached.txt
+func (p *PasswordPolicy) LoadBreachedList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if info.Size()%breachedRecordSize != 0 {
+		file.Close()
+		return fmt.Errorf("%s: every line must be a SHA-1 hash of %d hex characters", path, 2*sha1.Size)
+	}
+
+	count := info.Size() / breachedRecordSize
+
+	//the whole file can't be checked up front, but a wrong format shows in any record
+	if count > 0 {
+		first, err := readBreachedRecord(file, 0)
+		if err == nil {
+			var last []byte
+			last, err = readBreachedRecord(file, count-1)
+			if err == nil && bytes.Compare(first, last) > 0 {
+				err = errors.New("hashes must be sorted")
+			}
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	p.breached = file
+	p.breachedCount = count
+	return nil
+}
+
+// readBreachedRecord returns the i-th hash of the list, upper case.
+func readBreachedRecord(file *os.File, i int64) ([]byte, error) {
+	record := make([]byte, breachedRecordSize)
+
+	_, err := file.ReadAt(record, i*breachedRecordSize)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := bytes.ToUpper(record[:2*sha1.Size])
+	if record[2*sha1.Size] != '\n' {
+		return nil, fmt.Errorf("line %d: missing newline", i+1)
+	}
+	if _, err := hex.Decode(make([]byte, sha1.Size), hash); err != nil {
+		return nil, fmt.Errorf("line %d: invalid SHA-1 hash", i+1)
+	}
+
+	return hash, nil
+}
+
+// isBreached binary searches the list. A list that can't be read anymore
+// doesn't block password changes.
+func (p *PasswordPolicy) isBreached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	target := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+
+	low, high := int64(0), p.breachedCount
+	for low < high {
+		mid := low + (high-low)/2
+
+		hash, err := readBreachedRecord(p.breached, mid)
+		if err != nil {
+			return false
+		}
+
+		switch bytes.Compare(hash, target) {
+		case 0:
+			return true
+		case -1:
+			low = mid + 1
+		default:
+			high = mid
+		}
+	}
+
+	return false
+}
+
+// Validate adds an error for the password field of the given validator when
+// the password breaks the policy.
+func (p *PasswordPolicy) Validate(v *validator.Validator, password, name, email string) {
+	if p == nil {
+		return
+	}
+
+	if p.breached != nil {
+		v.Check(!p.isBreached(password), "password", "has appeared in a data breach, please choose another one")
+	}
+
+	if p.rejectPersonalInfo {
+		lower := strings.ToLower(password)
+
+		for _, part := range strings.Fields(strings.ToLower(name)) {
+			if len(part) >= 3 {
+				v.Check(!strings.Contains(lower, part), "password", "must not contain your name")
+			}
+		}
+
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if len(local) >= 3 {
+			v.Check(!strings.Contains(lower, local), "password", "must not contain your email address")
+		}
+	}
+}
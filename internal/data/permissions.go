@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"slices"
 	"time"
 
@@ -27,16 +26,37 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB    DBTX
+	Cache *PermissionCache
+	//set inside a transaction, the cache is bypassed there
+	pending *pendingInvalidations
 }
 
+// GetAllForUser returns the union of the permissions granted to the user
+// directly and the permissions bundled in the roles the user holds.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	//a transaction must neither see stale entries nor cache uncommitted rows
+	if m.pending == nil {
+		if permissions, found := m.Cache.get(userID); found {
+			return permissions, nil
+		}
+	}
+
+	//an invalidation during the query must win over its result
+	generation := m.Cache.generation(userID)
+
 	query := `
 				SELECT permissions.code
 				FROM permissions
 				INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 				INNER JOIN users ON users_permissions.user_id = users.id
 				WHERE users.id = $1
+				UNION
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+				INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+				WHERE users_roles.user_id = $1
 			`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -62,6 +82,10 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	if m.pending == nil {
+		m.Cache.set(userID, permissions, generation)
+	}
+
 	return permissions, nil
 
 }
@@ -69,9 +93,57 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
-	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.pending.invalidate(m.Cache, userID)
+	return err
+}
+
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+	DELETE FROM users_permissions
+	WHERE user_id = $1
+	AND permission_id IN (SELECT permissions.id FROM permissions WHERE permissions.code = ANY($2))`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.pending.invalidate(m.Cache, userID)
 	return err
 }
+
+// Retrieve every permission code known to the system
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+				SELECT code
+				FROM permissions
+				ORDER BY code
+			`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,146 @@
+package data
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PermissionCache keeps the permissions of each user in memory for a short
+// time, so requirePermission doesn't hit the database on every request.
+// A nil *PermissionCache is valid and caches nothing.
+type PermissionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int64]permissionCacheEntry
+	//bumped by every invalidation of the user, see generation
+	generations map[int64]uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+// NewPermissionCache returns a cache with the given ttl, or nil when ttl is 0.
+func NewPermissionCache(ttl time.Duration) *PermissionCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &PermissionCache{
+		ttl:         ttl,
+		entries:     make(map[int64]permissionCacheEntry),
+		generations: make(map[int64]uint64),
+	}
+}
+
+func (c *PermissionCache) get(userID int64) (Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[userID]
+	if !found || time.Now().After(entry.expiry) {
+		delete(c.entries, userID)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return slices.Clone(entry.permissions), true
+}
+
+// generation must be read before the permissions are loaded from the
+// database, and passed to set with them.
+func (c *PermissionCache) generation(userID int64) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generations[userID]
+}
+
+// set caches the permissions unless the user has been invalidated since the
+// given generation was read, the permissions may be stale then.
+func (c *PermissionCache) set(userID int64, permissions Permissions, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[userID] != generation {
+		return
+	}
+
+	c.entries[userID] = permissionCacheEntry{
+		permissions: slices.Clone(permissions),
+		expiry:      time.Now().Add(c.ttl),
+	}
+}
+
+// Invalidate drops the cached permissions of a user.
+func (c *PermissionCache) Invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+	c.generations[userID]++
+}
+
+// Stats returns the counters published through expvar.
+func (c *PermissionCache) Stats() map[string]int64 {
+	if c == nil {
+		return map[string]int64{"hits": 0, "misses": 0, "entries": 0}
+	}
+
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return map[string]int64{
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"entries": int64(entries),
+	}
+}
+
+// pendingInvalidations collects the users whose permissions are changed inside
+// a transaction. Their cache entries are only dropped once it has committed,
+// otherwise another request could cache the old rows again in between.
+type pendingInvalidations struct {
+	userIDs []int64
+}
+
+// invalidate drops the cached permissions of the user now, or after the
+// commit when p belongs to a transaction.
+func (p *pendingInvalidations) invalidate(c *PermissionCache, userID int64) {
+	if p == nil {
+		c.Invalidate(userID)
+		return
+	}
+
+	p.userIDs = append(p.userIDs, userID)
+}
+
+func (p *pendingInvalidations) flush(c *PermissionCache) {
+	for _, userID := range p.userIDs {
+		c.Invalidate(userID)
+	}
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A role bundles several permission codes under a single name
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB DBTX
+	//role changes alter the effective permissions of a user
+	Cache *PermissionCache
+	//set inside a transaction, see PermissionModel
+	pending *pendingInvalidations
+}
+
+// Retrieve every role together with the permission codes it grants
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+				SELECT roles.id, roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+				FROM roles
+				LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+				LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id
+				GROUP BY roles.id
+				ORDER BY roles.id
+			`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Name, pq.Array((*[]string)(&role.Permissions)))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Retrieve the names of the roles held by a user
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+				SELECT roles.name
+				FROM roles
+				INNER JOIN users_roles ON users_roles.role_id = roles.id
+				WHERE users_roles.user_id = $1
+				ORDER BY roles.name
+			`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+	INSERT INTO users_roles
+	SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+	ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	m.pending.invalidate(m.Cache, userID)
+	return err
+}
+
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+	DELETE FROM users_roles
+	WHERE user_id = $1
+	AND role_id IN (SELECT roles.id FROM roles WHERE roles.name = ANY($2))`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	m.pending.invalidate(m.Cache, userID)
+	return err
+}
@@ -6,22 +6,53 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/leebrouse/greenLight/internal/validator"
+	"github.com/lib/pq"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMagicLink      = "magic-link"
 )
 
+// A refresh token that has already been rotated was presented again
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int64     `json:"id"`
+	Plaintext  string    `json:"token,omitempty"`
+	Hash       []byte    `json:"-"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	Scope      string    `json:"-"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	//the new address waiting for confirmation (email-change scope only)
+	PendingEmail string `json:"-"`
+	//the permission codes the token is restricted to, nil means unrestricted
+	Permissions Permissions `json:"permissions,omitempty"`
+	//the access and refresh tokens issued by the same login share a family
+	Family string `json:"-"`
+}
+
+// Generate a random identifier for a new token family
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -49,13 +80,24 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// The bounds of the lifetime a client may ask for an authentication token
+const (
+	MinAuthenticationTokenTTL = time.Minute
+	MaxAuthenticationTokenTTL = 24 * time.Hour
+)
+
+func ValidateTokenTTL(v *validator.Validator, ttl time.Duration) {
+	v.Check(ttl >= MinAuthenticationTokenTTL, "ttl", "must be at least 1 minute")
+	v.Check(ttl <= MaxAuthenticationTokenTTL, "ttl", "must not be more than 24 hours")
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -68,22 +110,237 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// Create a new email-change token holding the address to be confirmed
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, pendingEmail string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	token.PendingEmail = pendingEmail
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// Create a new authentication or refresh token carrying the user, the client
+// metadata, the permission scope and the family of the given session
+func (m TokenModel) NewSession(scope string, ttl time.Duration, session Token) (*Token, error) {
+	token, err := generateToken(session.UserID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = session.UserAgent
+	token.ClientIP = session.ClientIP
+	token.Permissions = session.Permissions
+	token.Family = session.Family
+
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-				INSERT INTO tokens (hash,user_id,expiry,scope)
-				VALUES($1,$2,$3,$4)
+				INSERT INTO tokens (hash,user_id,expiry,scope,user_agent,client_ip,pending_email,permissions,family)
+				VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)
+				RETURNING id, created_at, last_used_at
 			`
 	//arguements array
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.ClientIP, token.PendingEmail, pq.Array([]string(token.Permissions)), token.Family}
 
 	//set ddl
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	//exec
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt, &token.LastUsedAt)
+}
 
-	return err
+// Retrieve an unexpired token by its plaintext
+func (m TokenModel) GetForToken(scope, tokenPlaintext string) (*Token, error) {
+	//get the tokenHash using the tokenPlaintext
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+				SELECT id, hash, user_id, created_at, last_used_at, expiry, scope, user_agent, client_ip, pending_email, permissions
+				FROM tokens
+				WHERE hash = $1 AND scope = $2 AND expiry > $3
+			`
+	args := []interface{}{tokenHash[:], scope, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var token Token
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.ID,
+		&token.Hash,
+		&token.UserID,
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.Expiry,
+		&token.Scope,
+		&token.UserAgent,
+		&token.ClientIP,
+		&token.PendingEmail,
+		pq.Array((*[]string)(&token.Permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.Plaintext = tokenPlaintext
+
+	return &token, nil
+}
+
+// Record that the given token has just been used and return it. Expired tokens
+// return ErrRecordNotFound. The row is only written when it wasn't used in the
+// last minute, so authenticating a request doesn't cost a write every time.
+func (m TokenModel) UpdateLastUsed(scope, tokenPlaintext, userAgent, clientIP string) (*Token, error) {
+	//get the tokenHash using the tokenPlaintext
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+				WITH token AS (
+					SELECT id, user_id, created_at, last_used_at, expiry, permissions, family
+					FROM tokens
+					WHERE hash = $3 AND scope = $4 AND expiry > NOW()
+				), touched AS (
+					UPDATE tokens
+					SET last_used_at = NOW(), user_agent = $1, client_ip = $2
+					WHERE id IN (SELECT id FROM token)
+					AND last_used_at < NOW() - INTERVAL '1 minute'
+				)
+				SELECT id, user_id, created_at, last_used_at, expiry, permissions, family
+				FROM token
+			`
+	args := []interface{}{userAgent, clientIP, tokenHash[:], scope}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     scope,
+		UserAgent: userAgent,
+		ClientIP:  clientIP,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.Expiry,
+		pq.Array((*[]string)(&token.Permissions)),
+		&token.Family,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Retrieve the unexpired tokens of a user, most recently used first
+func (m TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+	query := `
+				SELECT id, hash, user_id, created_at, last_used_at, expiry, scope, user_agent, client_ip, permissions
+				FROM tokens
+				WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL
+				ORDER BY last_used_at DESC, id DESC
+			`
+	args := []interface{}{scope, userID, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+
+		err := rows.Scan(
+			&token.ID,
+			&token.Hash,
+			&token.UserID,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.Expiry,
+			&token.Scope,
+			&token.UserAgent,
+			&token.ClientIP,
+			pq.Array((*[]string)(&token.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Delete a single token of a user by its id, together with the other tokens of its family
+func (m TokenModel) DeleteByID(scope string, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+				DELETE FROM tokens
+				WHERE user_id = $3
+				AND (
+					(id = $1 AND scope = $2)
+					OR family IN (SELECT family FROM tokens WHERE id = $1 AND scope = $2 AND family <> '')
+				)
+			`
+	args := []interface{}{id, scope, userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	//the number of the affected rows
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
 }
 
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
@@ -99,3 +356,176 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
+
+// Delete the authentication and refresh tokens of a user except the ones of
+// the current session, which may be nil
+func (m TokenModel) DeleteOtherSessions(userID int64, current *Token) error {
+	var id int64
+	var family string
+	if current != nil {
+		id, family = current.ID, current.Family
+	}
+
+	query := `
+				DELETE FROM tokens
+				WHERE user_id = $1
+				AND scope = ANY($2)
+				AND id <> $3
+				AND (family = '' OR family <> $4)
+			`
+	args := []interface{}{userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh}), id, family}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Delete a single token by the hash of the given plaintext, together with
+// the other tokens of its family
+func (m TokenModel) DeleteForToken(scope, tokenPlaintext string, userID int64) error {
+	//get the tokenHash using the tokenPlaintext
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+				DELETE FROM tokens
+				WHERE user_id = $3
+				AND (
+					(hash = $1 AND scope = $2)
+					OR family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $2 AND family <> '')
+				)
+			`
+	args := []interface{}{tokenHash[:], scope, userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	//the number of the affected rows
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Delete every token of a token family
+func (m TokenModel) DeleteFamily(family string, userID int64) error {
+	query := `
+				DELETE FROM tokens
+				WHERE family = $1 AND family <> '' AND user_id = $2
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family, userID)
+	return err
+}
+
+// Mark an unused refresh token as used and return it. If the token was
+// already used ErrTokenReused is returned, the caller must then revoke the
+// family with RevokeReusedFamily, outside of any transaction that is rolled back.
+func (m TokenModel) UseRefreshToken(tokenPlaintext string) (*Token, error) {
+	//get the tokenHash using the tokenPlaintext
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+				UPDATE tokens
+				SET used_at = NOW()
+				WHERE hash = $1 AND scope = $2 AND expiry > $3 AND used_at IS NULL
+				RETURNING id, user_id, created_at, last_used_at, expiry, permissions, family
+			`
+	args := []interface{}{tokenHash[:], ScopeRefresh, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.Expiry,
+		pq.Array((*[]string)(&token.Permissions)),
+		&token.Family,
+	)
+	if err == nil {
+		return &token, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	//either the token doesn't exist or it has been used before, in which case
+	//it was stolen or replayed and no token of the family can be trusted anymore
+	query = `
+				SELECT EXISTS (SELECT 1 FROM tokens WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL AND family <> '')
+			`
+
+	var reused bool
+	err = m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&reused)
+	if err != nil {
+		return nil, err
+	}
+
+	if reused {
+		return nil, ErrTokenReused
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+// Revoke the family of a refresh token that has been used before
+func (m TokenModel) RevokeReusedFamily(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+				DELETE FROM tokens
+				WHERE family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL AND family <> '')
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ScopeRefresh)
+	return err
+}
+
+// Delete up to limit expired tokens and return how many rows were deleted
+func (m TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+				DELETE FROM tokens
+				WHERE id IN (
+					SELECT id FROM tokens
+					WHERE expiry < $1
+					LIMIT $2
+				)
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
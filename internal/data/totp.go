@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/leebrouse/greenLight/internal/totp"
+	"github.com/lib/pq"
+)
+
+// A one-time password was valid but its time step has been used before
+var ErrOTPReplayed = errors.New("one-time password replayed")
+
+// TOTP is the second factor of a user. It only protects the account once
+// the enrolment has been confirmed with a valid code.
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// Validate checks the code against the current time step and skew steps on
+// each side. Steps at or before the last accepted one are refused, so a code
+// can't be replayed. It returns the step to record with UseStep.
+func (t *TOTP) Validate(code string, now time.Time, skew int) (int64, bool) {
+	step, ok := totp.Validate(t.Secret, code, now, skew)
+	if !ok || step <= t.LastUsedStep {
+		return 0, false
+	}
+
+	return step, true
+}
+
+type TOTPModel struct {
+	DB DBTX
+}
+
+// Start (or restart) the enrolment of a user with a new secret
+func (m TOTPModel) Upsert(userID int64, secret string) error {
+	query := `
+				INSERT INTO users_totp (user_id, secret)
+				VALUES ($1, $2)
+				ON CONFLICT (user_id) DO UPDATE
+				SET secret = EXCLUDED.secret, enabled = false, last_used_step = 0, created_at = NOW()
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+				SELECT user_id, secret, enabled, last_used_step, created_at
+				FROM users_totp
+				WHERE user_id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var totp TOTP
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&totp.Enabled,
+		&totp.LastUsedStep,
+		&totp.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// Enable the second factor once the enrolment has been confirmed
+func (m TOTPModel) Enable(userID int64) error {
+	query := `
+				UPDATE users_totp
+				SET enabled = true
+				WHERE user_id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Record the time step of an accepted code. A step at or before the last
+// accepted one returns ErrOTPReplayed, so every code works only once.
+func (m TOTPModel) UseStep(userID, step int64) error {
+	query := `
+				UPDATE users_totp
+				SET last_used_step = $2
+				WHERE user_id = $1 AND last_used_step < $2
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrOTPReplayed
+	}
+
+	return nil
+}
+
+// Remove the second factor and its recovery codes, in a single statement
+func (m TOTPModel) Delete(userID int64) error {
+	query := `
+				WITH recovery_codes AS (
+					DELETE FROM totp_recovery_codes WHERE user_id = $1
+				)
+				DELETE FROM users_totp
+				WHERE user_id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Replace the recovery codes of a user with n new ones and return them in plaintext
+func (m TOTPModel) NewRecoveryCodes(userID int64, n int) ([]string, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+
+	for i := range codes {
+		//10 random characters, shown as xxxxx-xxxxx
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+		codes[i] = strings.ToLower(code[:5] + "-" + code[5:])
+
+		hash := sha256.Sum256([]byte(codes[i]))
+		hashes[i] = hash[:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+				INSERT INTO totp_recovery_codes (hash, user_id)
+				SELECT unnest($2::bytea[]), $1
+			`
+
+	_, err = m.DB.ExecContext(ctx, query, userID, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Spend a recovery code, it returns false if the code doesn't exist
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+
+	query := `
+				DELETE FROM totp_recovery_codes
+				WHERE hash = $1 AND user_id = $2
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hash[:], userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
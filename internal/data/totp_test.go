@@ -0,0 +1,131 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leebrouse/greenLight/internal/totp"
+)
+
+// the SHA1 seed of RFC 6238 appendix B, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the RFC 6238 SHA1 test vectors, truncated to the 6 digits we use
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPValidateRFC6238(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		secondFactor := &TOTP{Secret: rfc6238Secret}
+		now := time.Unix(tt.unix, 0)
+
+		step, ok := secondFactor.Validate(tt.code, now, 0)
+		if !ok {
+			t.Errorf("code %s at %d: not accepted", tt.code, tt.unix)
+			continue
+		}
+
+		if step != totp.Step(now) {
+			t.Errorf("code %s at %d: got step %d, want %d", tt.code, tt.unix, step, totp.Step(now))
+		}
+	}
+}
+
+func TestTOTPValidateSkew(t *testing.T) {
+	secondFactor := &TOTP{Secret: rfc6238Secret}
+	issued := time.Unix(1111111111, 0)
+	code := "050471"
+
+	tests := []struct {
+		name string
+		now  time.Time
+		skew int
+		want bool
+	}{
+		{"same step", issued, 1, true},
+		{"one step later", issued.Add(totp.Period), 1, true},
+		{"one step earlier", issued.Add(-totp.Period), 1, true},
+		{"two steps later", issued.Add(2 * totp.Period), 1, false},
+		{"two steps earlier", issued.Add(-2 * totp.Period), 1, false},
+		{"one step later without skew", issued.Add(totp.Period), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := secondFactor.Validate(code, tt.now, tt.skew)
+			if ok != tt.want {
+				t.Fatalf("got %v, want %v", ok, tt.want)
+			}
+
+			//the step of the code is returned, not the current one
+			if ok && step != totp.Step(issued) {
+				t.Errorf("got step %d, want %d", step, totp.Step(issued))
+			}
+		})
+	}
+}
+
+func TestTOTPValidateRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totp.Step(now)
+	code := "050471"
+
+	tests := []struct {
+		name         string
+		lastUsedStep int64
+		want         bool
+	}{
+		{"never used", 0, true},
+		{"older step used", step - 1, true},
+		{"same step used", step, false},
+		//a code of the next step was accepted within the skew window
+		{"newer step used", step + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secondFactor := &TOTP{Secret: rfc6238Secret, LastUsedStep: tt.lastUsedStep}
+
+			_, ok := secondFactor.Validate(code, now, 1)
+			if ok != tt.want {
+				t.Errorf("got %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPValidateRejectsBadCodes(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{"wrong code", rfc6238Secret, "050472"},
+		{"too short", rfc6238Secret, "05047"},
+		{"too long", rfc6238Secret, "0504711"},
+		{"empty", rfc6238Secret, ""},
+		{"other secret", "JBSWY3DPEHPK3PXP", "050471"},
+		{"invalid secret", "not base32!", "050471"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secondFactor := &TOTP{Secret: tt.secret}
+
+			if _, ok := secondFactor.Validate(tt.code, now, 1); ok {
+				t.Errorf("code %q accepted", tt.code)
+			}
+		})
+	}
+}
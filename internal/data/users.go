@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/leebrouse/greenLight/internal/validator"
@@ -40,7 +41,7 @@ type password struct {
 }
 
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashArgon2id(plaintextPassword, PasswordHashParams)
 	if err != nil {
 		return err
 	}
@@ -50,7 +51,13 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// Matches checks the password against argon2id hashes, and against the
+// bcrypt hashes created before argon2id was introduced.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if isArgon2id(p.hash) {
+		return compareArgon2id(p.hash, plaintextPassword)
+	}
+
 	if err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword)); err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
@@ -63,6 +70,21 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// NeedsRehash reports whether the hash was made with bcrypt or with other
+// argon2id parameters than the current ones.
+func (p *password) NeedsRehash() bool {
+	if !isArgon2id(p.hash) {
+		return true
+	}
+
+	params, _, _, err := decodeArgon2id(p.hash)
+	if err != nil {
+		return true
+	}
+
+	return params != PasswordHashParams
+}
+
 /*Validate check*/
 
 // ValidateEmail
@@ -101,7 +123,7 @@ var (
 )
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func (m *UserModel) Insert(user *User) error {
@@ -128,6 +150,44 @@ func (m *UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m *UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	var user User
+
+	query := `
+				SELECT id, created_at, name, email, password_hash, activated, version
+				FROM users
+				WHERE id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 func (m *UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
@@ -200,6 +260,91 @@ func (m *UserModel) Update(user *User) error {
 	return nil
 }
 
+// Delete the user, tokens and permissions are removed by the ON DELETE CASCADE
+func (m *UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+				DELETE FROM users
+				WHERE id = $1
+			`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	//the number of the affected rows
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Retrieve a page of users, optionally filtered by name and email
+func (m *UserModel) GetAll(name, email string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version
+							FROM users
+							WHERE (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+							AND (email ILIKE '%%' || $2 || '%%' OR $2 = '')
+							ORDER BY %s %s, id ASC
+							LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{name, email, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 // A submethod for retrieving the user by the given token
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	//get the tokenHash using the tokenPlaintext
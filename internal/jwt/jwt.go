@@ -0,0 +1,259 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+	ErrNotYetValid  = errors.New("token not valid yet")
+	ErrUnknownKey   = errors.New("unknown key id")
+)
+
+// Supported algorithms, using the names of the JWT "alg" header.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// {
+// 	"sub": "42",
+// 	"iat": 1760700000,
+// 	"nbf": 1760700000,
+// 	"exp": 1760700900,
+// 	"sid": "FMYWGBSPJ6QWWQ5FEQYOAGOKJA",
+// 	"act": true,
+// 	"scp": ["movies:read"]
+// }
+
+type Claims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	//the token family (session) the token belongs to
+	SessionID string `json:"sid,omitempty"`
+	//whether the user was activated when the token was issued
+	Activated bool `json:"act"`
+	//the permission codes the token is restricted to, nil means unrestricted
+	Scope *[]string `json:"scp,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Key is a signing or verification key identified by its key ID.
+type Key struct {
+	ID         string
+	Alg        string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// LoadKey reads a key from a local file. HS256 keys are the raw secret (at
+// least 32 bytes), EdDSA keys are a PEM encoded PKCS #8 private key or, for
+// verification only, a PKIX public key.
+func LoadKey(id, alg, path string) (*Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: id, Alg: alg}
+
+	switch alg {
+	case AlgHS256:
+		if len(content) < 32 {
+			return nil, fmt.Errorf("key %q: HMAC secret must be at least 32 bytes long", id)
+		}
+		key.secret = content
+
+	case AlgEdDSA:
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("key %q: no PEM data found", id)
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("key %q: not an Ed25519 private key", id)
+			}
+			key.privateKey = privateKey
+			key.publicKey = privateKey.Public().(ed25519.PublicKey)
+		case "PUBLIC KEY":
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			publicKey, ok := parsed.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("key %q: not an Ed25519 public key", id)
+			}
+			key.publicKey = publicKey
+		default:
+			return nil, fmt.Errorf("key %q: unsupported PEM block %q", id, block.Type)
+		}
+
+	default:
+		return nil, fmt.Errorf("key %q: unsupported algorithm %q", id, alg)
+	}
+
+	return key, nil
+}
+
+func (k *Key) canSign() bool {
+	return k.secret != nil || k.privateKey != nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Alg == AlgHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+
+	return ed25519.Sign(k.privateKey, input)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Alg == AlgHS256 {
+		return hmac.Equal(k.sign(input), signature)
+	}
+
+	return ed25519.Verify(k.publicKey, input, signature)
+}
+
+// KeySet signs with one key and verifies with any key it holds, so old keys
+// can stay around for verification while tokens signed with them expire.
+type KeySet struct {
+	signingKey *Key
+	keys       map[string]*Key
+}
+
+func NewKeySet(signingKeyID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key)}
+
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	signingKey, ok := ks.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q: %w", signingKeyID, ErrUnknownKey)
+	}
+	if !signingKey.canSign() {
+		return nil, fmt.Errorf("signing key %q can only verify", signingKeyID)
+	}
+	ks.signingKey = signingKey
+
+	return ks, nil
+}
+
+var encoding = base64.RawURLEncoding
+
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	headerJSON, err := json.Marshal(header{Alg: ks.signingKey.Alg, Kid: ks.signingKey.ID, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	signature := ks.signingKey.sign([]byte(input))
+
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, the expiry and the not-before time of the token
+// and returns its claims. The claims are trusted as they are, a signed token
+// stays valid until it expires even if its session is revoked.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := ks.keys[h.Kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	//never let the token pick the algorithm of the key
+	if h.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claimsJSON, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	if now.Unix() < claims.NotBefore {
+		return nil, ErrNotYetValid
+	}
+
+	return &claims, nil
+}
+
+// IsSigned reports whether the token looks like a signed token rather than an
+// opaque one.
+func IsSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
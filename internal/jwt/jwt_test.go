@@ -0,0 +1,245 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1760700000, 0)
+
+func newTestKeySet(t *testing.T) (*KeySet, *Key, *Key) {
+	t.Helper()
+
+	hmacKey := &Key{ID: "hmac", Alg: AlgHS256, secret: []byte(strings.Repeat("s", 32))}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := &Key{ID: "ed", Alg: AlgEdDSA, privateKey: privateKey, publicKey: publicKey}
+
+	ks, err := NewKeySet("hmac", hmacKey, edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ks, hmacKey, edKey
+}
+
+func validClaims() Claims {
+	scope := []string{"movies:read"}
+	return Claims{
+		Subject:   "42",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(15 * time.Minute).Unix(),
+		SessionID: "FMYWGBSPJ6QWWQ5FEQYOAGOKJA",
+		Activated: true,
+		Scope:     &scope,
+	}
+}
+
+// forge builds a token from raw header and claims, signed with the given key
+// unless it is nil.
+func forge(t *testing.T, h header, claims Claims, key *Key) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	if key == nil {
+		return input + "."
+	}
+
+	return input + "." + encoding.EncodeToString(key.sign([]byte(input)))
+}
+
+func TestSignAndVerify(t *testing.T) {
+	ks, hmacKey, edKey := newTestKeySet(t)
+
+	for _, key := range []*Key{hmacKey, edKey} {
+		t.Run(key.Alg, func(t *testing.T) {
+			token := forge(t, header{Alg: key.Alg, Kid: key.ID, Typ: "JWT"}, validClaims(), key)
+
+			claims, err := ks.Verify(token, now)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+
+			if claims.Subject != "42" || claims.SessionID != "FMYWGBSPJ6QWWQ5FEQYOAGOKJA" || !claims.Activated {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+			if claims.Scope == nil || len(*claims.Scope) != 1 || (*claims.Scope)[0] != "movies:read" {
+				t.Errorf("unexpected scope %v", claims.Scope)
+			}
+		})
+	}
+
+	token, err := ks.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSigned(token) {
+		t.Errorf("IsSigned(%q) = false", token)
+	}
+	if _, err := ks.Verify(token, now); err != nil {
+		t.Errorf("Verify of a signed token: %v", err)
+	}
+}
+
+func TestVerifyRejectsBadSignatures(t *testing.T) {
+	ks, hmacKey, edKey := newTestKeySet(t)
+
+	otherSecret := &Key{ID: "hmac", Alg: AlgHS256, secret: []byte(strings.Repeat("x", 32))}
+
+	valid := forge(t, header{Alg: AlgHS256, Kid: "hmac"}, validClaims(), hmacKey)
+	parts := strings.Split(valid, ".")
+
+	tampered := validClaims()
+	tampered.Subject = "1"
+	tamperedJSON, _ := json.Marshal(tampered)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong secret", forge(t, header{Alg: AlgHS256, Kid: "hmac"}, validClaims(), otherSecret), ErrInvalidToken},
+		{"tampered claims", parts[0] + "." + encoding.EncodeToString(tamperedJSON) + "." + parts[2], ErrInvalidToken},
+		{"stripped signature", parts[0] + "." + parts[1] + ".", ErrInvalidToken},
+		{"unknown key", forge(t, header{Alg: AlgHS256, Kid: "gone"}, validClaims(), hmacKey), ErrUnknownKey},
+		//the public key is no secret, it must not work as an HMAC key
+		{"alg confusion", forge(t, header{Alg: AlgHS256, Kid: "ed"}, validClaims(), &Key{Alg: AlgHS256, secret: edKey.publicKey}), ErrInvalidToken},
+		{"alg switched to EdDSA", forge(t, header{Alg: AlgEdDSA, Kid: "hmac"}, validClaims(), edKey), ErrInvalidToken},
+		{"alg none", forge(t, header{Alg: "none", Kid: "hmac"}, validClaims(), nil), ErrInvalidToken},
+		{"alg none without kid", forge(t, header{Alg: "none"}, validClaims(), nil), ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTimes(t *testing.T) {
+	ks, hmacKey, _ := newTestKeySet(t)
+	h := header{Alg: AlgHS256, Kid: "hmac"}
+
+	noExpiry := validClaims()
+	noExpiry.ExpiresAt = 0
+
+	notYetValid := validClaims()
+	notYetValid.NotBefore = now.Add(time.Minute).Unix()
+
+	noNotBefore := validClaims()
+	noNotBefore.NotBefore = 0
+
+	tests := []struct {
+		name   string
+		claims Claims
+		at     time.Time
+		want   error
+	}{
+		{"valid", validClaims(), now, nil},
+		{"last second", validClaims(), now.Add(15*time.Minute - time.Second), nil},
+		{"expired at exp", validClaims(), now.Add(15 * time.Minute), ErrExpiredToken},
+		{"expired after exp", validClaims(), now.Add(time.Hour), ErrExpiredToken},
+		{"missing exp", noExpiry, now, ErrExpiredToken},
+		{"before nbf", notYetValid, now, ErrNotYetValid},
+		{"at nbf", notYetValid, now.Add(time.Minute), nil},
+		{"missing nbf", noNotBefore, now, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(forge(t, h, tt.claims, hmacKey), tt.at)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	ks, hmacKey, _ := newTestKeySet(t)
+
+	valid := forge(t, header{Alg: AlgHS256, Kid: "hmac"}, validClaims(), hmacKey)
+	parts := strings.Split(valid, ".")
+
+	//a correctly signed token whose claims are not JSON
+	input := parts[0] + "." + encoding.EncodeToString([]byte("not json"))
+	badClaims := input + "." + encoding.EncodeToString(hmacKey.sign([]byte(input)))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"one segment", parts[0]},
+		{"two segments", parts[0] + "." + parts[1]},
+		{"four segments", valid + "." + parts[2]},
+		{"header not base64", "!!!." + parts[1] + "." + parts[2]},
+		{"header not JSON", encoding.EncodeToString([]byte("{")) + "." + parts[1] + "." + parts[2]},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!!"},
+		{"padded signature", valid + "="},
+		{"claims not JSON", badClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token, now)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+
+	short := filepath.Join(dir, "short.key")
+	if err := os.WriteFile(short, []byte("too short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey("short", AlgHS256, short); err == nil {
+		t.Error("expected an error for a short HMAC secret")
+	}
+
+	if _, err := LoadKey("none", "none", short); err == nil {
+		t.Error("expected an error for the none algorithm")
+	}
+}
+
+func TestNewKeySetRequiresSigningKey(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyOnly := &Key{ID: "ed", Alg: AlgEdDSA, publicKey: publicKey}
+
+	if _, err := NewKeySet("ed", verifyOnly); err == nil {
+		t.Error("expected an error for a verification-only signing key")
+	}
+	if _, err := NewKeySet("missing", verifyOnly); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v, want %v", err, ErrUnknownKey)
+	}
+}
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS pending_email citext NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- NULL means the token carries every permission of its user.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS permissions text[];
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    hash bytea UNIQUE NOT NULL,
+    -- only this address can register with the invitation when it is set
+    email citext,
+    -- the permission codes the invited user gets instead of the default ones
+    permissions text[] NOT NULL,
+    created_by bigint REFERENCES users ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    used_by bigint REFERENCES users ON DELETE SET NULL,
+    used_at timestamp(0) with time zone
+);
@@ -0,0 +1,17 @@
+INSERT INTO permissions (code)
+VALUES
+('reviews:write');
+
+-- Every role may write reviews.
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name IN ('viewer', 'editor', 'admin') AND permissions.code = 'reviews:write';
+
+-- Users who could review with movies:read so far keep doing so.
+INSERT INTO users_permissions
+SELECT users_permissions.user_id, reviews_write.id
+FROM users_permissions
+INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+CROSS JOIN (SELECT id FROM permissions WHERE code = 'reviews:write') AS reviews_write
+WHERE permissions.code = 'movies:read'
+ON CONFLICT DO NOTHING;